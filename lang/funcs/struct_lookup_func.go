@@ -0,0 +1,580 @@
+// Mgmt
+// Copyright (C) 2013-2024+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Additional permission under GNU GPL version 3 section 7
+//
+// If you modify this program, or any covered work, by linking or combining it
+// with embedded mcl code and modules (and that the embedded mcl code and
+// modules which link with this program, contain a copy of their source code in
+// the authoritative form) containing parts covered by the terms of any other
+// license, the licensors of this program grant you additional permission to
+// convey the resulting work. Furthermore, the licensors of this program grant
+// the original author, James Shubin, additional permission to update this
+// additional permission if he deems it necessary to achieve the goals of this
+// additional permission.
+
+package funcs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/purpleidea/mgmt/lang/interfaces"
+	"github.com/purpleidea/mgmt/lang/types"
+	"github.com/purpleidea/mgmt/util/errwrap"
+)
+
+const (
+	// StructLookupFuncName is the name this function is registered as.
+	// This starts with an underscore so that it cannot be used from the
+	// lexer.
+	StructLookupFuncName = "_struct_lookup"
+
+	// arg names...
+	structLookupArgNameStruct = "struct"
+	structLookupArgNameField  = "field"
+)
+
+func init() {
+	Register(StructLookupFuncName, func() interfaces.Func { return &StructLookupFunc{} }) // must register the func and name
+}
+
+var _ interfaces.PolyFunc = &StructLookupFunc{} // ensure it meets this expectation
+
+// StructLookupFunc is a struct field lookup function. Unlike
+// StructLookupOptionalFunc, there's no default value to fall back on: if the
+// field (or, for a dotted path like `"outer.inner"`, any intermediate
+// segment along the way) doesn't exist on the struct, that's a build-time
+// error instead of something we paper over at runtime. The field may be a
+// dotted path that descends through nested struct-kind fields, the same way
+// StructLookupOptionalFunc's does.
+type StructLookupFunc struct {
+	Type *types.Type // Kind == Struct, that is used as the struct we lookup
+	Out  *types.Type // type of field we're extracting
+
+	init  *interfaces.Init
+	last  types.Value // last value received to use for diff
+	field []string    // cached, dotted field split on "."
+
+	result types.Value // last calculated output
+}
+
+// setField caches the dotted field path the first time it's seen, the same
+// way StructLookupOptionalFunc.setField does.
+func (obj *StructLookupFunc) setField(field string) error {
+	path := strings.Split(field, ".")
+	if obj.field == nil {
+		obj.field = path // store first path
+		return nil
+	}
+	if !fieldPathEqual(obj.field, path) {
+		return fmt.Errorf("input field changed from: `%s`, to: `%s`", strings.Join(obj.field, "."), field)
+	}
+	return nil
+}
+
+// lookupPathStrict descends through a struct value following the given
+// dotted field path, the same way lookupPath does, except it has no optional
+// value to fall back on: it reports whether the whole chain resolved
+// instead of silently substituting something else.
+func lookupPathStrict(st *types.StructValue, path []string) (types.Value, bool) {
+	val, exists := st.Lookup(path[0])
+	if !exists {
+		return nil, false
+	}
+	if len(path) == 1 {
+		return val, true
+	}
+	next, ok := val.(*types.StructValue)
+	if !ok { // shouldn't happen if Build validated the chain
+		return nil, false
+	}
+	return lookupPathStrict(next, path[1:])
+}
+
+// String returns a simple name for this function. This is needed so this struct
+// can satisfy the pgraph.Vertex interface.
+func (obj *StructLookupFunc) String() string {
+	return StructLookupFuncName
+}
+
+// ArgGen returns the Nth arg name for this function.
+func (obj *StructLookupFunc) ArgGen(index int) (string, error) {
+	seq := []string{structLookupArgNameStruct, structLookupArgNameField}
+	if l := len(seq); index >= l {
+		return "", fmt.Errorf("index %d exceeds arg length of %d", index, l)
+	}
+	return seq[index], nil
+}
+
+// Unify returns the list of invariants that this func produces.
+func (obj *StructLookupFunc) Unify(expr interfaces.Expr) ([]interfaces.Invariant, error) {
+	var invariants []interfaces.Invariant
+	var invar interfaces.Invariant
+
+	// func(struct T1, field str) T2
+
+	structName, err := obj.ArgGen(0)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldName, err := obj.ArgGen(1)
+	if err != nil {
+		return nil, err
+	}
+
+	dummyStruct := &interfaces.ExprAny{} // corresponds to the struct type
+	dummyField := &interfaces.ExprAny{}  // corresponds to the field type
+	dummyOut := &interfaces.ExprAny{}    // corresponds to the out string
+
+	// field arg type of string
+	invar = &interfaces.EqualsInvariant{
+		Expr: dummyField,
+		Type: types.TypeStr,
+	}
+	invariants = append(invariants, invar)
+
+	// full function
+	mapped := make(map[string]interfaces.Expr)
+	ordered := []string{structName, fieldName}
+	mapped[structName] = dummyStruct
+	mapped[fieldName] = dummyField
+
+	invar = &interfaces.EqualityWrapFuncInvariant{
+		Expr1:    expr, // maps directly to us!
+		Expr2Map: mapped,
+		Expr2Ord: ordered,
+		Expr2Out: dummyOut,
+	}
+	invariants = append(invariants, invar)
+
+	// learn inspects fnInvariants/solved and returns whatever new
+	// invariants it can, plus the struct (t1) and leaf (t2) types it
+	// managed to pin down this round, if any, and whether it even found
+	// the CallFuncArgsValueInvariant that ties us to our ExprCall. See
+	// StructLookupOptionalFunc.Unify's learn for the full rationale.
+	learn := func(fnInvariants []interfaces.Invariant, solved map[interfaces.Expr]*types.Type) (*types.Type, *types.Type, []interfaces.Invariant, bool, error) {
+		for _, invariant := range fnInvariants {
+			// search for this special type of invariant
+			cfavInvar, ok := invariant.(*interfaces.CallFuncArgsValueInvariant)
+			if !ok {
+				continue
+			}
+			// did we find the mapping from us to ExprCall ?
+			if cfavInvar.Func != expr {
+				continue
+			}
+			// cfavInvar.Expr is the ExprCall! (the return pointer)
+			// cfavInvar.Args are the args that ExprCall uses!
+			if l := len(cfavInvar.Args); l != 2 {
+				return nil, nil, nil, true, fmt.Errorf("unable to build function with %d args", l)
+			}
+
+			var invariants []interfaces.Invariant
+			var invar interfaces.Invariant
+
+			// add the relationship to the returned value
+			invar = &interfaces.EqualityInvariant{
+				Expr1: cfavInvar.Expr,
+				Expr2: dummyOut,
+			}
+			invariants = append(invariants, invar)
+
+			// add the relationships to the called args
+			invar = &interfaces.EqualityInvariant{
+				Expr1: cfavInvar.Args[0],
+				Expr2: dummyStruct,
+			}
+			invariants = append(invariants, invar)
+
+			invar = &interfaces.EqualityInvariant{
+				Expr1: cfavInvar.Args[1],
+				Expr2: dummyField,
+			}
+			invariants = append(invariants, invar)
+
+			// second arg must be a string
+			invar = &interfaces.EqualsInvariant{
+				Expr: cfavInvar.Args[1],
+				Type: types.TypeStr,
+			}
+			invariants = append(invariants, invar)
+
+			// Not necessary for the field to be known or be static!
+			var field string
+			var path []string
+			value, err := cfavInvar.Args[1].Value() // is it known?
+			if err == nil {
+				if k := value.Type().Kind; k != types.KindStr {
+					return nil, nil, nil, true, fmt.Errorf("unable to build function with 1st arg of kind: %s", k)
+				}
+				field = value.Str() // must not panic
+				path = strings.Split(field, ".")
+
+				// Cache it now, since Build only sees types, not
+				// argument values, and it needs the path later to
+				// validate the chain once the struct type is known.
+				if err := obj.setField(field); err != nil {
+					return nil, nil, nil, true, errwrap.Wrapf(err, "field path is inconsistent")
+				}
+			}
+
+			// If we figure out both of these types, we'll know the
+			var t1 *types.Type // struct type
+			var t2 *types.Type // leaf (return) type
+
+			// validateArg0 checks: struct T1
+			validateArg0 := func(typ *types.Type) error {
+				if typ == nil { // unknown so far
+					return nil
+				}
+
+				// we happen to have a struct!
+				if k := typ.Kind; k != types.KindStruct {
+					return fmt.Errorf("unable to build function with 0th arg of kind: %s", k)
+				}
+
+				if len(path) > 0 {
+					leaf, err := descendType(typ, path)
+					if err != nil {
+						return errwrap.Wrapf(err, "could not descend struct field path")
+					}
+					// Unlike StructLookupOptionalFunc, there's
+					// no fallback value, so a missing field
+					// anywhere along the path is an error here.
+					if leaf == nil {
+						return fmt.Errorf("struct is missing field: %s", field)
+					}
+					if err := leaf.Cmp(t2); t2 != nil && err != nil {
+						return errwrap.Wrapf(err, "input type was inconsistent")
+					}
+
+					// learn!
+					t2 = leaf
+				}
+
+				if err := typ.Cmp(t1); t1 != nil && err != nil {
+					return errwrap.Wrapf(err, "input type was inconsistent")
+				}
+
+				// learn!
+				t1 = typ
+				return nil
+			}
+
+			validateOut := func(typ *types.Type) error {
+				if typ == nil { // unknown so far
+					return nil
+				}
+
+				if err := typ.Cmp(t2); t2 != nil && err != nil {
+					return errwrap.Wrapf(err, "input type was inconsistent")
+				}
+
+				// learn!
+				t2 = typ
+				return nil
+			}
+
+			if typ, err := cfavInvar.Args[0].Type(); err == nil { // is it known?
+				// this sets t1 (and sometimes t2) on success if it learned
+				if err := validateArg0(typ); err != nil {
+					return nil, nil, nil, true, errwrap.Wrapf(err, "first struct arg type is inconsistent")
+				}
+			}
+			if typ, exists := solved[cfavInvar.Args[0]]; exists { // alternate way to lookup type
+				// this sets t1 (and sometimes t2) on success if it learned
+				if err := validateArg0(typ); err != nil {
+					return nil, nil, nil, true, errwrap.Wrapf(err, "first struct arg type is inconsistent")
+				}
+			}
+
+			// look at the return type too (if known)
+			if typ, err := cfavInvar.Expr.Type(); err == nil { // is it known?
+				// this sets t2 on success if it learned
+				if err := validateOut(typ); err != nil {
+					return nil, nil, nil, true, errwrap.Wrapf(err, "return type is inconsistent")
+				}
+			}
+			if typ, exists := solved[cfavInvar.Expr]; exists { // alternate way to lookup type
+				// this sets t2 on success if it learned
+				if err := validateOut(typ); err != nil {
+					return nil, nil, nil, true, errwrap.Wrapf(err, "return type is inconsistent")
+				}
+			}
+
+			if t1 != nil {
+				invar = &interfaces.EqualsInvariant{
+					Expr: dummyStruct,
+					Type: t1,
+				}
+				invariants = append(invariants, invar)
+
+				// We know *some* information about the struct!
+				// Chain one PartialStructInvariant per path segment,
+				// descending through each nested struct level,
+				// without having to pin down any of the sibling
+				// fields we don't care about at each level. Unlike
+				// StructLookupOptionalFunc, a field missing
+				// anywhere along the chain is a hard error here,
+				// since there's no optional value to fall back on.
+				chain, err := buildChainInvariants(dummyStruct, t1, path, dummyOut)
+				if err != nil {
+					return nil, nil, nil, true, errwrap.Wrapf(err, "could not build struct chain invariants")
+				}
+				if len(path) > 0 && len(chain) == 0 {
+					return nil, nil, nil, true, fmt.Errorf("struct is missing field: %s", field)
+				}
+				invariants = append(invariants, chain...)
+			}
+			if t2 != nil {
+				invar = &interfaces.EqualsInvariant{
+					Expr: dummyOut,
+					Type: t2,
+				}
+				invariants = append(invariants, invar)
+			}
+
+			// TODO: do we return this relationship with ExprCall?
+			invar = &interfaces.EqualityWrapCallInvariant{
+				// TODO: should Expr1 and Expr2 be reversed???
+				Expr1: cfavInvar.Expr,
+				//Expr2Func: cfavInvar.Func, // same as below
+				Expr2Func: expr,
+			}
+			invariants = append(invariants, invar)
+
+			// TODO: are there any other invariants we should build?
+			return t1, t2, invariants, true, nil // learn return
+		}
+		// We never even found our own CallFuncArgsValueInvariant this round.
+		return nil, nil, nil, false, fmt.Errorf("couldn't generate new invariants")
+	}
+
+	// fingerprint counts how many of t1 and t2 learn managed to pin down
+	// this round, so a later pass can tell whether it actually saw new
+	// information, or would just spin on the same inputs forever.
+	fingerprint := func(t1, t2 *types.Type) int {
+		n := 0
+		if t1 != nil {
+			n++
+		}
+		if t2 != nil {
+			n++
+		}
+		return n
+	}
+
+	// wrap builds a generator that re-runs learn on every pass, but only
+	// defers again while the fingerprint has strictly grown past seen, and
+	// otherwise gives up with "couldn't generate new invariants". Since
+	// the fingerprint is at most 2, this can't spin forever.
+	var wrap func(seen int) func([]interfaces.Invariant, map[interfaces.Expr]*types.Type) ([]interfaces.Invariant, error)
+	wrap = func(seen int) func([]interfaces.Invariant, map[interfaces.Expr]*types.Type) ([]interfaces.Invariant, error) {
+		return func(fnInvariants []interfaces.Invariant, solved map[interfaces.Expr]*types.Type) ([]interfaces.Invariant, error) {
+			t1, t2, invars, foundCfav, err := learn(fnInvariants, solved)
+			if err != nil {
+				return nil, err
+			}
+
+			if foundCfav && (t1 == nil || t2 == nil) {
+				fp := fingerprint(t1, t2)
+				if fp <= seen {
+					// Nothing new since last time -- give up
+					// instead of looping forever.
+					return nil, fmt.Errorf("couldn't generate new invariants")
+				}
+
+				// This is the first pass, or we pinned down more
+				// than last time, but not both types yet. Hold
+				// back what learn built this round, and come back
+				// later once the solver has made more progress.
+				return []interfaces.Invariant{
+					&interfaces.GeneratorInvariant{
+						Func: wrap(fp),
+					},
+				}, nil
+			}
+
+			return invars, nil
+		}
+	}
+
+	invar = &interfaces.GeneratorInvariant{
+		Func: wrap(-1),
+	}
+	invariants = append(invariants, invar)
+
+	return invariants, nil
+}
+
+// Build is run to turn the polymorphic, undetermined function, into the
+// specific statically typed version. It is usually run after Unify completes,
+// and must be run before Info() and any of the other Func interface methods are
+// used. This function is idempotent, as long as the arg isn't changed between
+// runs.
+func (obj *StructLookupFunc) Build(typ *types.Type) (*types.Type, error) {
+	// typ is the KindFunc signature we're trying to build...
+	if typ.Kind != types.KindFunc {
+		return nil, fmt.Errorf("input type must be of kind func")
+	}
+
+	if len(typ.Ord) != 2 {
+		return nil, fmt.Errorf("the structlookup function needs exactly two args")
+	}
+	if typ.Out == nil {
+		return nil, fmt.Errorf("return type of function must be specified")
+	}
+	if typ.Map == nil {
+		return nil, fmt.Errorf("invalid input type")
+	}
+
+	tStruct, exists := typ.Map[typ.Ord[0]]
+	if !exists || tStruct == nil {
+		return nil, fmt.Errorf("first arg must be specified")
+	}
+	if tStruct.Kind != types.KindStruct {
+		return nil, fmt.Errorf("first arg must be of kind struct")
+	}
+
+	tField, exists := typ.Map[typ.Ord[1]]
+	if !exists || tField == nil {
+		return nil, fmt.Errorf("second arg must be specified")
+	}
+	if err := tField.Cmp(types.TypeStr); err != nil {
+		return nil, errwrap.Wrapf(err, "field must be an str")
+	}
+
+	obj.Type = tStruct // struct type
+	obj.Out = typ.Out  // type of return value
+
+	// Unlike StructLookupOptionalFunc, we have no fallback value, so we
+	// need Unify to have actually learned the (possibly dotted) field
+	// path, and for the whole chain to resolve to a field whose type
+	// matches what we're returning.
+	if len(obj.field) == 0 {
+		return nil, fmt.Errorf("field path is still unspecified")
+	}
+	leaf, err := descendType(obj.Type, obj.field)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "invalid field path")
+	}
+	if leaf == nil {
+		return nil, fmt.Errorf("struct is missing field: %s", strings.Join(obj.field, "."))
+	}
+	if err := leaf.Cmp(obj.Out); err != nil {
+		return nil, errwrap.Wrapf(err, "leaf field type doesn't match return type")
+	}
+
+	return obj.sig(), nil
+}
+
+// Validate tells us if the input struct takes a valid form.
+func (obj *StructLookupFunc) Validate() error {
+	if obj.Type == nil { // build must be run first
+		return fmt.Errorf("type is still unspecified")
+	}
+	if obj.Type.Kind != types.KindStruct {
+		return fmt.Errorf("type must be a kind of struct")
+	}
+	if obj.Out == nil {
+		return fmt.Errorf("return type must be specified")
+	}
+
+	return nil
+}
+
+// Info returns some static info about itself. Build must be called before this
+// will return correct data.
+func (obj *StructLookupFunc) Info() *interfaces.Info {
+	var sig *types.Type
+	if obj.Type != nil { // don't panic if called speculatively
+		sig = obj.sig() // helper
+	}
+	return &interfaces.Info{
+		Pure: true,
+		Memo: false,
+		Sig:  sig, // func kind
+		Err:  obj.Validate(),
+	}
+}
+
+// helper
+func (obj *StructLookupFunc) sig() *types.Type {
+	return types.NewType(fmt.Sprintf("func(%s %s, %s str) %s", structLookupArgNameStruct, obj.Type.String(), structLookupArgNameField, obj.Out.String()))
+}
+
+// Init runs some startup code for this function.
+func (obj *StructLookupFunc) Init(init *interfaces.Init) error {
+	obj.init = init
+	return nil
+}
+
+// Stream returns the changing values that this func has over time.
+func (obj *StructLookupFunc) Stream(ctx context.Context) error {
+	defer close(obj.init.Output) // the sender closes
+	for {
+		select {
+		case input, ok := <-obj.init.Input:
+			if !ok {
+				return nil // can't output any more
+			}
+
+			if obj.last != nil && input.Cmp(obj.last) == nil {
+				continue // value didn't change, skip it
+			}
+			obj.last = input // store for next
+
+			st := (input.Struct()[structLookupArgNameStruct]).(*types.StructValue)
+			field := input.Struct()[structLookupArgNameField].Str()
+
+			if field == "" {
+				return fmt.Errorf("received empty field")
+			}
+			if err := obj.setField(field); err != nil {
+				return err
+			}
+
+			// Build already validated that this path resolves
+			// against our declared struct type, so this should
+			// never actually miss, but we check anyways.
+			result, exists := lookupPathStrict(st, obj.field)
+			if !exists {
+				return fmt.Errorf("struct is missing field: %s", field)
+			}
+
+			// if previous input was `2 + 4`, but now it
+			// changed to `1 + 5`, the result is still the
+			// same, so we can skip sending an update...
+			if obj.result != nil && result.Cmp(obj.result) == nil {
+				continue // result didn't change
+			}
+			obj.result = result // store new result
+
+		case <-ctx.Done():
+			return nil
+		}
+
+		select {
+		case obj.init.Output <- obj.result: // send
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
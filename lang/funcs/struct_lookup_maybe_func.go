@@ -0,0 +1,539 @@
+// Mgmt
+// Copyright (C) 2013-2024+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Additional permission under GNU GPL version 3 section 7
+//
+// If you modify this program, or any covered work, by linking or combining it
+// with embedded mcl code and modules (and that the embedded mcl code and
+// modules which link with this program, contain a copy of their source code in
+// the authoritative form) containing parts covered by the terms of any other
+// license, the licensors of this program grant you additional permission to
+// convey the resulting work. Furthermore, the licensors of this program grant
+// the original author, James Shubin, additional permission to update this
+// additional permission if he deems it necessary to achieve the goals of this
+// additional permission.
+
+package funcs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/purpleidea/mgmt/lang/interfaces"
+	"github.com/purpleidea/mgmt/lang/types"
+	"github.com/purpleidea/mgmt/util/errwrap"
+)
+
+const (
+	// StructLookupMaybeFuncName is the name this function is registered
+	// as. This starts with an underscore so that it cannot be used from
+	// the lexer.
+	StructLookupMaybeFuncName = "_struct_lookup_maybe"
+
+	// arg names...
+	structLookupMaybeArgNameStruct = "struct"
+	structLookupMaybeArgNameField  = "field"
+
+	// structLookupMaybeFieldValue is the name of the `value` field in our
+	// output struct.
+	structLookupMaybeFieldValue = "value"
+	// structLookupMaybeFieldPresent is the name of the `present` field in
+	// our output struct.
+	structLookupMaybeFieldPresent = "present"
+)
+
+func init() {
+	Register(StructLookupMaybeFuncName, func() interfaces.Func { return &StructLookupMaybeFunc{} }) // must register the func and name
+}
+
+var _ interfaces.PolyFunc = &StructLookupMaybeFunc{} // ensure it meets this expectation
+
+// StructLookupMaybeFunc is a struct field lookup function. Unlike
+// StructLookupOptionalFunc, it never requires the caller to supply a default,
+// and unlike a plain lookup, it never errors at build time when the field is
+// absent from the struct. Instead it returns a comma-ok style result, similar
+// to Go's comma-ok addressing mode (see `operand.go`'s `valueok`): a struct
+// with a `present` bool telling you whether the field existed, and a `value`
+// that holds the field's value when it did, or the zero value of its type
+// when it didn't. This lets mcl programs distinguish "field missing" from
+// "field explicitly set to its zero value".
+type StructLookupMaybeFunc struct {
+	Type *types.Type // Kind == Struct, that is used as the struct we lookup
+	Out  *types.Type // type of the `value` field we're extracting (T2)
+
+	init *interfaces.Init
+	last types.Value // last value received to use for diff
+	field string
+
+	result types.Value // last calculated output
+}
+
+// String returns a simple name for this function. This is needed so this
+// struct can satisfy the pgraph.Vertex interface.
+func (obj *StructLookupMaybeFunc) String() string {
+	return StructLookupMaybeFuncName
+}
+
+// ArgGen returns the Nth arg name for this function.
+func (obj *StructLookupMaybeFunc) ArgGen(index int) (string, error) {
+	seq := []string{structLookupMaybeArgNameStruct, structLookupMaybeArgNameField}
+	if l := len(seq); index >= l {
+		return "", fmt.Errorf("index %d exceeds arg length of %d", index, l)
+	}
+	return seq[index], nil
+}
+
+// Unify returns the list of invariants that this func produces.
+func (obj *StructLookupMaybeFunc) Unify(expr interfaces.Expr) ([]interfaces.Invariant, error) {
+	var invariants []interfaces.Invariant
+	var invar interfaces.Invariant
+
+	// func(struct T1, field str) struct{value T2; present bool}
+
+	structName, err := obj.ArgGen(0)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldName, err := obj.ArgGen(1)
+	if err != nil {
+		return nil, err
+	}
+
+	dummyStruct := &interfaces.ExprAny{}  // corresponds to the struct type (T1)
+	dummyField := &interfaces.ExprAny{}   // corresponds to the field type (str)
+	dummyValue := &interfaces.ExprAny{}   // corresponds to the `value` field (T2)
+	dummyPresent := &interfaces.ExprAny{} // corresponds to the `present` field (bool)
+	dummyOut := &interfaces.ExprAny{}     // corresponds to our struct{value T2; present bool} result
+
+	// field arg type of string
+	invar = &interfaces.EqualsInvariant{
+		Expr: dummyField,
+		Type: types.TypeStr,
+	}
+	invariants = append(invariants, invar)
+
+	// present is always a bool, whether or not we know T2 yet
+	invar = &interfaces.EqualsInvariant{
+		Expr: dummyPresent,
+		Type: types.TypeBool,
+	}
+	invariants = append(invariants, invar)
+
+	// our output is always exactly this two-field struct
+	mapped := make(map[string]interfaces.Expr)
+	ordered := []string{structLookupMaybeFieldValue, structLookupMaybeFieldPresent}
+	mapped[structLookupMaybeFieldValue] = dummyValue
+	mapped[structLookupMaybeFieldPresent] = dummyPresent
+	invar = &interfaces.EqualityWrapStructInvariant{
+		Expr1:    dummyOut,
+		Expr2Map: mapped,
+		Expr2Ord: ordered,
+	}
+	invariants = append(invariants, invar)
+
+	// full function
+	mapped = make(map[string]interfaces.Expr)
+	ordered = []string{structName, fieldName}
+	mapped[structName] = dummyStruct
+	mapped[fieldName] = dummyField
+
+	invar = &interfaces.EqualityWrapFuncInvariant{
+		Expr1:    expr, // maps directly to us!
+		Expr2Map: mapped,
+		Expr2Ord: ordered,
+		Expr2Out: dummyOut,
+	}
+	invariants = append(invariants, invar)
+
+	// generator function
+	fn := func(fnInvariants []interfaces.Invariant, solved map[interfaces.Expr]*types.Type) ([]interfaces.Invariant, error) {
+		for _, invariant := range fnInvariants {
+			// search for this special type of invariant
+			cfavInvar, ok := invariant.(*interfaces.CallFuncArgsValueInvariant)
+			if !ok {
+				continue
+			}
+			// did we find the mapping from us to ExprCall ?
+			if cfavInvar.Func != expr {
+				continue
+			}
+			// cfavInvar.Expr is the ExprCall! (the return pointer)
+			// cfavInvar.Args are the args that ExprCall uses!
+			if l := len(cfavInvar.Args); l != 2 {
+				return nil, fmt.Errorf("unable to build function with %d args", l)
+			}
+
+			var invariants []interfaces.Invariant
+			var invar interfaces.Invariant
+
+			// add the relationship to the returned value
+			invar = &interfaces.EqualityInvariant{
+				Expr1: cfavInvar.Expr,
+				Expr2: dummyOut,
+			}
+			invariants = append(invariants, invar)
+
+			// add the relationships to the called args
+			invar = &interfaces.EqualityInvariant{
+				Expr1: cfavInvar.Args[0],
+				Expr2: dummyStruct,
+			}
+			invariants = append(invariants, invar)
+
+			invar = &interfaces.EqualityInvariant{
+				Expr1: cfavInvar.Args[1],
+				Expr2: dummyField,
+			}
+			invariants = append(invariants, invar)
+
+			// second arg must be a string
+			invar = &interfaces.EqualsInvariant{
+				Expr: cfavInvar.Args[1],
+				Type: types.TypeStr,
+			}
+			invariants = append(invariants, invar)
+
+			// Not necessary for the field to be known or be static!
+			var field string
+			value, err := cfavInvar.Args[1].Value() // is it known?
+			if err == nil {
+				if k := value.Type().Kind; k != types.KindStr {
+					return nil, fmt.Errorf("unable to build function with 1st arg of kind: %s", k)
+				}
+				field = value.Str() // must not panic
+			}
+
+			// If we figure out both of these types, we'll know the
+			var t1 *types.Type // struct type
+			var t2 *types.Type // value (T2) type
+
+			// validateArg0 checks: struct T1
+			validateArg0 := func(typ *types.Type) error {
+				if typ == nil { // unknown so far
+					return nil
+				}
+
+				// we happen to have a struct!
+				if k := typ.Kind; k != types.KindStruct {
+					return fmt.Errorf("unable to build function with 0th arg of kind: %s", k)
+				}
+
+				// check both Ord and Map for safety
+				found := false
+				for _, s := range typ.Ord {
+					if s == field {
+						found = true
+						break
+					}
+				}
+				// NOTE: unlike StructLookupFunc, it's never an
+				// error if this struct doesn't have the field --
+				// that's the whole point of `present`.
+				if t, exists := typ.Map[field]; field != "" && exists && found {
+					if err := t.Cmp(t2); t2 != nil && err != nil {
+						return errwrap.Wrapf(err, "input type was inconsistent")
+					}
+
+					// learn!
+					t2 = t
+				}
+
+				if err := typ.Cmp(t1); t1 != nil && err != nil {
+					return errwrap.Wrapf(err, "input type was inconsistent")
+				}
+
+				// learn!
+				t1 = typ
+				return nil
+			}
+
+			// validateOutValue checks the `value` field of our
+			// output struct, or the learned T2 directly.
+			validateOutValue := func(typ *types.Type) error {
+				if typ == nil { // unknown so far
+					return nil
+				}
+
+				if err := typ.Cmp(t2); t2 != nil && err != nil {
+					return errwrap.Wrapf(err, "input type was inconsistent")
+				}
+
+				// learn!
+				t2 = typ
+				return nil
+			}
+
+			if typ, err := cfavInvar.Args[0].Type(); err == nil { // is it known?
+				// this sets t1 (and sometimes t2) on success if it learned
+				if err := validateArg0(typ); err != nil {
+					return nil, errwrap.Wrapf(err, "first struct arg type is inconsistent")
+				}
+			}
+			if typ, exists := solved[cfavInvar.Args[0]]; exists { // alternate way to lookup type
+				// this sets t1 (and sometimes t2) on success if it learned
+				if err := validateArg0(typ); err != nil {
+					return nil, errwrap.Wrapf(err, "first struct arg type is inconsistent")
+				}
+			}
+
+			// look at the return type too (if known), by peeling
+			// its `value` field back out
+			getValueType := func(typ *types.Type) *types.Type {
+				if typ == nil || typ.Kind != types.KindStruct {
+					return nil
+				}
+				return typ.Map[structLookupMaybeFieldValue]
+			}
+			if typ, err := cfavInvar.Expr.Type(); err == nil { // is it known?
+				if err := validateOutValue(getValueType(typ)); err != nil {
+					return nil, errwrap.Wrapf(err, "return struct's value field type is inconsistent")
+				}
+			}
+			if typ, exists := solved[cfavInvar.Expr]; exists { // alternate way to lookup type
+				if err := validateOutValue(getValueType(typ)); err != nil {
+					return nil, errwrap.Wrapf(err, "return struct's value field type is inconsistent")
+				}
+			}
+
+			if t1 != nil {
+				invar = &interfaces.EqualsInvariant{
+					Expr: dummyStruct,
+					Type: t1,
+				}
+				invariants = append(invariants, invar)
+
+				// We know *some* information about the struct!
+				// Let's hope the unusedField expr won't trip
+				// up the solver...
+				mapped := make(map[string]interfaces.Expr)
+				ordered := []string{}
+				for _, x := range t1.Ord {
+					// We *don't* need to solve unusedField
+					unusedField := &interfaces.ExprAny{}
+					mapped[x] = unusedField
+					if x == field { // the one we care about
+						mapped[x] = dummyValue
+					}
+					ordered = append(ordered, x)
+				}
+				invar = &interfaces.EqualityWrapStructInvariant{
+					Expr1:    dummyStruct,
+					Expr2Map: mapped,
+					Expr2Ord: ordered,
+				}
+				// We only want to add this weird thing if the
+				// field actually exists. Otherwise ignore it,
+				// and `present` will just be false at runtime.
+				if _, exists := t1.Map[field]; field != "" && exists {
+					invariants = append(invariants, invar)
+				}
+			}
+			if t2 != nil {
+				invar = &interfaces.EqualsInvariant{
+					Expr: dummyValue,
+					Type: t2,
+				}
+				invariants = append(invariants, invar)
+			}
+
+			// TODO: do we return this relationship with ExprCall?
+			invar = &interfaces.EqualityWrapCallInvariant{
+				// TODO: should Expr1 and Expr2 be reversed???
+				Expr1: cfavInvar.Expr,
+				//Expr2Func: cfavInvar.Func, // same as below
+				Expr2Func: expr,
+			}
+			invariants = append(invariants, invar)
+
+			// TODO: are there any other invariants we should build?
+			return invariants, nil // generator return
+		}
+		// We couldn't tell the solver anything it didn't already know!
+		return nil, fmt.Errorf("couldn't generate new invariants")
+	}
+	invar = &interfaces.GeneratorInvariant{
+		Func: fn,
+	}
+	invariants = append(invariants, invar)
+
+	return invariants, nil
+}
+
+// Build is run to turn the polymorphic, undetermined function, into the
+// specific statically typed version. It is usually run after Unify completes,
+// and must be run before Info() and any of the other Func interface methods
+// are used. This function is idempotent, as long as the arg isn't changed
+// between runs.
+func (obj *StructLookupMaybeFunc) Build(typ *types.Type) (*types.Type, error) {
+	// typ is the KindFunc signature we're trying to build...
+	if typ.Kind != types.KindFunc {
+		return nil, fmt.Errorf("input type must be of kind func")
+	}
+
+	if len(typ.Ord) != 2 {
+		return nil, fmt.Errorf("the structlookupmaybe function needs exactly two args")
+	}
+	if typ.Out == nil {
+		return nil, fmt.Errorf("return type of function must be specified")
+	}
+	if typ.Map == nil {
+		return nil, fmt.Errorf("invalid input type")
+	}
+
+	tStruct, exists := typ.Map[typ.Ord[0]]
+	if !exists || tStruct == nil {
+		return nil, fmt.Errorf("first arg must be specified")
+	}
+	if tStruct.Kind != types.KindStruct {
+		return nil, fmt.Errorf("first arg must be of kind struct")
+	}
+
+	tField, exists := typ.Map[typ.Ord[1]]
+	if !exists || tField == nil {
+		return nil, fmt.Errorf("second arg must be specified")
+	}
+	if err := tField.Cmp(types.TypeStr); err != nil {
+		return nil, errwrap.Wrapf(err, "field must be an str")
+	}
+
+	if typ.Out.Kind != types.KindStruct {
+		return nil, fmt.Errorf("return type must be a struct")
+	}
+	tValue, exists := typ.Out.Map[structLookupMaybeFieldValue]
+	if !exists || tValue == nil {
+		return nil, fmt.Errorf("return struct is missing a `%s` field", structLookupMaybeFieldValue)
+	}
+	tPresent, exists := typ.Out.Map[structLookupMaybeFieldPresent]
+	if !exists || tPresent == nil {
+		return nil, fmt.Errorf("return struct is missing a `%s` field", structLookupMaybeFieldPresent)
+	}
+	if err := tPresent.Cmp(types.TypeBool); err != nil {
+		return nil, errwrap.Wrapf(err, "present field must be a bool")
+	}
+
+	// NOTE: We actually don't know which field this is, only its type! It
+	// turns out it's not actually necessary for us to know it to build the
+	// struct.
+	obj.Type = tStruct // struct type
+	obj.Out = tValue   // type of the `value` field
+
+	return obj.sig(), nil
+}
+
+// Validate tells us if the input struct takes a valid form.
+func (obj *StructLookupMaybeFunc) Validate() error {
+	if obj.Type == nil { // build must be run first
+		return fmt.Errorf("type is still unspecified")
+	}
+	if obj.Type.Kind != types.KindStruct {
+		return fmt.Errorf("type must be a kind of struct")
+	}
+	if obj.Out == nil {
+		return fmt.Errorf("value type must be specified")
+	}
+
+	return nil
+}
+
+// Info returns some static info about itself. Build must be called before
+// this will return correct data.
+func (obj *StructLookupMaybeFunc) Info() *interfaces.Info {
+	var sig *types.Type
+	if obj.Type != nil { // don't panic if called speculatively
+		sig = obj.sig() // helper
+	}
+	return &interfaces.Info{
+		Pure: true,
+		Memo: false,
+		Sig:  sig, // func kind
+		Err:  obj.Validate(),
+	}
+}
+
+// helper
+func (obj *StructLookupMaybeFunc) sig() *types.Type {
+	return types.NewType(fmt.Sprintf("func(%s %s, %s str) struct{%s %s; %s bool}", structLookupMaybeArgNameStruct, obj.Type.String(), structLookupMaybeArgNameField, structLookupMaybeFieldValue, obj.Out.String(), structLookupMaybeFieldPresent))
+}
+
+// Init runs some startup code for this function.
+func (obj *StructLookupMaybeFunc) Init(init *interfaces.Init) error {
+	obj.init = init
+	return nil
+}
+
+// Stream returns the changing values that this func has over time.
+func (obj *StructLookupMaybeFunc) Stream(ctx context.Context) error {
+	defer close(obj.init.Output) // the sender closes
+	for {
+		select {
+		case input, ok := <-obj.init.Input:
+			if !ok {
+				return nil // can't output any more
+			}
+
+			if obj.last != nil && input.Cmp(obj.last) == nil {
+				continue // value didn't change, skip it
+			}
+			obj.last = input // store for next
+
+			st := (input.Struct()[structLookupMaybeArgNameStruct]).(*types.StructValue)
+			field := input.Struct()[structLookupMaybeArgNameField].Str()
+
+			if field == "" {
+				return fmt.Errorf("received empty field")
+			}
+			if obj.field == "" {
+				obj.field = field // store first field
+			}
+			if field != obj.field {
+				return fmt.Errorf("input field changed from: `%s`, to: `%s`", obj.field, field)
+			}
+
+			val, exists := st.Lookup(field)
+			if !exists {
+				val = obj.Out.New() // zero value of T2
+			}
+
+			st2, err := types.NewStruct(obj.sig().Out)
+			if err != nil {
+				return errwrap.Wrapf(err, "could not build result struct")
+			}
+			st2.Struct()[structLookupMaybeFieldValue] = val
+			st2.Struct()[structLookupMaybeFieldPresent] = &types.BoolValue{V: exists}
+
+			result := types.Value(st2)
+
+			// if previous input was `2 + 4`, but now it
+			// changed to `1 + 5`, the result is still the
+			// same, so we can skip sending an update...
+			if obj.result != nil && result.Cmp(obj.result) == nil {
+				continue // result didn't change
+			}
+			obj.result = result // store new result
+
+		case <-ctx.Done():
+			return nil
+		}
+
+		select {
+		case obj.init.Output <- obj.result: // send
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Mgmt
+// Copyright (C) 2013-2024+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Additional permission under GNU GPL version 3 section 7
+//
+// If you modify this program, or any covered work, by linking or combining it
+// with embedded mcl code and modules (and that the embedded mcl code and
+// modules which link with this program, contain a copy of their source code in
+// the authoritative form) containing parts covered by the terms of any other
+// license, the licensors of this program grant you additional permission to
+// convey the resulting work. Furthermore, the licensors of this program grant
+// the original author, James Shubin, additional permission to update this
+// additional permission if he deems it necessary to achieve the goals of this
+// additional permission.
+
+package funcs
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/lang/interfaces"
+	"github.com/purpleidea/mgmt/lang/types"
+)
+
+// runStructLookupMaybe builds fn with the given struct/out types, sends one
+// (struct, field) input, and returns the (value, present) result or an error.
+func runStructLookupMaybe(t *testing.T, structType string, fields map[string]types.Value, field string, out *types.Type) (types.Value, bool, error) {
+	t.Helper()
+
+	fn := &StructLookupMaybeFunc{
+		Type: types.NewType(structType),
+		Out:  out,
+	}
+
+	stVal, err := types.NewStruct(fn.Type)
+	if err != nil {
+		t.Fatalf("could not build struct value: %+v", err)
+	}
+	for k, v := range fields {
+		stVal.Struct()[k] = v
+	}
+
+	argType := types.NewType(fmt.Sprintf("struct{%s %s; %s str}", structLookupMaybeArgNameStruct, structType, structLookupMaybeArgNameField))
+	argVal, err := types.NewStruct(argType)
+	if err != nil {
+		t.Fatalf("could not build arg value: %+v", err)
+	}
+	argVal.Struct()[structLookupMaybeArgNameStruct] = stVal
+	argVal.Struct()[structLookupMaybeArgNameField] = &types.StrValue{V: field}
+
+	input := make(chan types.Value)
+	output := make(chan types.Value)
+	if err := fn.Init(&interfaces.Init{Input: input, Output: output}); err != nil {
+		t.Fatalf("could not init: %+v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- fn.Stream(ctx) }()
+
+	select {
+	case input <- argVal:
+	case <-time.After(time.Second):
+		t.Fatal("timed out sending input")
+	}
+
+	var result types.Value
+	select {
+	case result = <-output:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for output")
+	}
+
+	close(input)
+	if err := <-errCh; err != nil {
+		return nil, false, err
+	}
+
+	value := result.Struct()[structLookupMaybeFieldValue]
+	present := result.Struct()[structLookupMaybeFieldPresent].(*types.BoolValue).V
+	return value, present, nil
+}
+
+func TestStructLookupMaybeFuncStream(t *testing.T) {
+	tests := []struct {
+		name        string
+		field       string
+		wantValue   types.Value
+		wantPresent bool
+	}{
+		{
+			name:        "field present",
+			field:       "a",
+			wantValue:   &types.IntValue{V: 42},
+			wantPresent: true,
+		},
+		{
+			name:        "field absent",
+			field:       "b",
+			wantValue:   &types.IntValue{}, // zero value of T2
+			wantPresent: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			value, present, err := runStructLookupMaybe(
+				t,
+				"struct{a int}",
+				map[string]types.Value{"a": &types.IntValue{V: 42}},
+				tc.field,
+				types.TypeInt,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if present != tc.wantPresent {
+				t.Errorf("present = %v, want %v", present, tc.wantPresent)
+			}
+			if err := value.Cmp(tc.wantValue); err != nil {
+				t.Errorf("value = %+v, want %+v (cmp err: %+v)", value, tc.wantValue, err)
+			}
+		})
+	}
+}
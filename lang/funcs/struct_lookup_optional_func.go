@@ -32,6 +32,7 @@ package funcs
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/purpleidea/mgmt/lang/interfaces"
 	"github.com/purpleidea/mgmt/lang/types"
@@ -60,18 +61,138 @@ var _ interfaces.PolyFunc = &StructLookupOptionalFunc{} // ensure it meets this
 // trick in that it will unify on a struct that doesn't have the specified field
 // in it, but in that case, it will always return the optional value. This is a
 // bit different from the "default" mechanism that is used by list and map
-// lookup functions.
+// lookup functions. The field may also be a dotted path like `"outer.inner"`
+// which descends through nested struct-kind fields, analogous to how
+// `types.LookupFieldOrMethod` walks an index chain through embedded fields.
+// If any intermediate segment of the path is missing, we also fall back to
+// the optional value.
 type StructLookupOptionalFunc struct {
 	Type *types.Type // Kind == Struct, that is used as the struct we lookup
 	Out  *types.Type // type of field we're extracting (also the type of optional)
 
 	init  *interfaces.Init
 	last  types.Value // last value received to use for diff
-	field string
+	field []string    // cached, dotted field split on "."
 
 	result types.Value // last calculated output
 }
 
+// setField caches the dotted field path the first time it's seen, splitting
+// it on "." only once, and rejects any attempt to change it afterwards, since
+// a single func value can't flip-flop between two different static paths.
+func (obj *StructLookupOptionalFunc) setField(field string) error {
+	path := strings.Split(field, ".")
+	if obj.field == nil {
+		obj.field = path // store first path
+		return nil
+	}
+	if !fieldPathEqual(obj.field, path) {
+		return fmt.Errorf("input field changed from: `%s`, to: `%s`", strings.Join(obj.field, "."), field)
+	}
+	return nil
+}
+
+// fieldPathEqual compares two dotted field paths for equality.
+func fieldPathEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, s := range a {
+		if s != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupPath descends through a struct value following the given dotted
+// field path, returning optional as soon as an intermediate (or leaf)
+// segment is missing.
+func lookupPath(st *types.StructValue, path []string, optional types.Value) types.Value {
+	val, exists := st.Lookup(path[0])
+	if !exists {
+		return optional
+	}
+	if len(path) == 1 {
+		return val
+	}
+	next, ok := val.(*types.StructValue)
+	if !ok { // shouldn't happen if Build validated the chain
+		return optional
+	}
+	return lookupPath(next, path[1:], optional)
+}
+
+// descendType walks typ through the path segments, following nested struct
+// kinds the same way lookupPath does at runtime, and returns the leaf
+// segment's type. It returns a nil type (with no error) as soon as a segment
+// is missing, and leaves it to the caller to decide what that means:
+// StructLookupOptionalFunc falls back to the optional value, while
+// StructLookupFunc reports an error.
+func descendType(typ *types.Type, path []string) (*types.Type, error) {
+	cur := typ
+	for i, seg := range path {
+		if cur.Kind != types.KindStruct {
+			return nil, fmt.Errorf("path segment %d (%s) expects a struct, got: %s", i, seg, cur.Kind)
+		}
+		next, exists := cur.Map[seg]
+		if !exists {
+			return nil, nil // missing field, the caller decides
+		}
+		if i == len(path)-1 {
+			return next, nil
+		}
+		cur = next
+	}
+	return nil, nil // empty path (shouldn't happen)
+}
+
+// buildChainInvariants builds one PartialStructInvariant per path segment,
+// descending from rootExpr/rootType through each nested struct level. Each
+// level only says that expr has this one field, of this one type -- unlike
+// an EqualityWrapStructInvariant, it says nothing about that struct's other
+// fields, so mcl code reading a struct value from an unknown source can be
+// checked against only the fields it actually reads. At each level, the
+// segment's field is tied (via a fresh ExprAny placeholder, or leafExpr for
+// the final segment) to that field's concrete type. If the field is missing
+// at any level, we stop and return whatever we built so far, matching the
+// existing "only add if field exists" rule.
+func buildChainInvariants(rootExpr interfaces.Expr, rootType *types.Type, path []string, leafExpr interfaces.Expr) ([]interfaces.Invariant, error) {
+	var invariants []interfaces.Invariant
+	expr := rootExpr
+	typ := rootType
+	for i, seg := range path {
+		if typ.Kind != types.KindStruct {
+			return nil, fmt.Errorf("expected struct kind at path segment %d (%s), got: %s", i, seg, typ.Kind)
+		}
+		fieldType, exists := typ.Map[seg]
+		if seg == "" || !exists {
+			return invariants, nil // field missing at this level, stop here
+		}
+
+		nextExpr := leafExpr // terminal segment maps to the out/optional type
+		if i < len(path)-1 {
+			nextExpr = &interfaces.ExprAny{} // fresh placeholder for the next struct level
+		}
+
+		invariants = append(invariants,
+			&interfaces.PartialStructInvariant{
+				Expr:      expr,
+				Field:     seg,
+				FieldType: fieldType,
+			},
+			&interfaces.EqualsInvariant{
+				Expr: nextExpr,
+				Type: fieldType,
+			},
+		)
+
+		typ = fieldType
+		expr = nextExpr
+	}
+	return invariants, nil
+}
+
 // String returns a simple name for this function. This is needed so this struct
 // can satisfy the pgraph.Vertex interface.
 func (obj *StructLookupOptionalFunc) String() string {
@@ -121,19 +242,6 @@ func (obj *StructLookupOptionalFunc) Unify(expr interfaces.Expr) ([]interfaces.I
 	}
 	invariants = append(invariants, invar)
 
-	// XXX: we could use this relationship *if* our solver could understand
-	// different fields, and partial struct matches. I guess we'll leave it
-	// for another day!
-	//mapped := make(map[string]interfaces.Expr)
-	//ordered := []string{???}
-	//mapped[???] = dummyField
-	//invar = &interfaces.EqualityWrapStructInvariant{
-	//	Expr1:    dummyStruct,
-	//	Expr2Map: mapped,
-	//	Expr2Ord: ordered,
-	//}
-	//invariants = append(invariants, invar)
-
 	// These two types should be identical. This is the safest approach. In
 	// the case where the struct field is missing, then this should be true,
 	// and when it is present, we'll never use the optional value, but we
@@ -159,8 +267,14 @@ func (obj *StructLookupOptionalFunc) Unify(expr interfaces.Expr) ([]interfaces.I
 	}
 	invariants = append(invariants, invar)
 
-	// generator function
-	fn := func(fnInvariants []interfaces.Invariant, solved map[interfaces.Expr]*types.Type) ([]interfaces.Invariant, error) {
+	// learn inspects fnInvariants/solved and returns whatever new
+	// invariants it can, plus the struct (t1) and optional/leaf (t2)
+	// types it managed to pin down this round, if any, and whether it
+	// even found the CallFuncArgsValueInvariant that ties us to our
+	// ExprCall. It's factored out of the generator so that the generator
+	// itself can decide whether to return these invariants now, or come
+	// back and call learn() again once more information is available.
+	learn := func(fnInvariants []interfaces.Invariant, solved map[interfaces.Expr]*types.Type) (*types.Type, *types.Type, []interfaces.Invariant, bool, error) {
 		for _, invariant := range fnInvariants {
 			// search for this special type of invariant
 			cfavInvar, ok := invariant.(*interfaces.CallFuncArgsValueInvariant)
@@ -174,7 +288,7 @@ func (obj *StructLookupOptionalFunc) Unify(expr interfaces.Expr) ([]interfaces.I
 			// cfavInvar.Expr is the ExprCall! (the return pointer)
 			// cfavInvar.Args are the args that ExprCall uses!
 			if l := len(cfavInvar.Args); l != 3 {
-				return nil, fmt.Errorf("unable to build function with %d args", l)
+				return nil, nil, nil, true, fmt.Errorf("unable to build function with %d args", l)
 			}
 
 			var invariants []interfaces.Invariant
@@ -215,17 +329,26 @@ func (obj *StructLookupOptionalFunc) Unify(expr interfaces.Expr) ([]interfaces.I
 
 			// Not necessary for the field to be known or be static!
 			var field string
+			var path []string
 			value, err := cfavInvar.Args[1].Value() // is it known?
 			if err == nil {
 				if k := value.Type().Kind; k != types.KindStr {
-					return nil, fmt.Errorf("unable to build function with 1st arg of kind: %s", k)
+					return nil, nil, nil, true, fmt.Errorf("unable to build function with 1st arg of kind: %s", k)
 				}
 				field = value.Str() // must not panic
+				path = strings.Split(field, ".")
+
+				// Cache it now, since Build only sees types, not
+				// argument values, and it needs the path later to
+				// validate the chain once the struct type is known.
+				if err := obj.setField(field); err != nil {
+					return nil, nil, nil, true, errwrap.Wrapf(err, "field path is inconsistent")
+				}
 			}
 
 			// If we figure out both of these types, we'll know the
 			var t1 *types.Type // struct type
-			var t2 *types.Type // optional / return type
+			var t2 *types.Type // optional / return (leaf) type
 
 			// validateArg0 checks: struct T1
 			validateArg0 := func(typ *types.Type) error {
@@ -238,24 +361,20 @@ func (obj *StructLookupOptionalFunc) Unify(expr interfaces.Expr) ([]interfaces.I
 					return fmt.Errorf("unable to build function with 0th arg of kind: %s", k)
 				}
 
-				// check both Ord and Map for safety
-				found := false
-				for _, s := range typ.Ord {
-					if s == field {
-						found = true
-						break
-					}
-				}
-				t, exists := typ.Map[field] // type found is T2
-				if field != "" {
-					if !exists || !found {
-						//fmt.Printf("might be using optional arg, struct is missing field: %s\n", field)
-					} else if err := t.Cmp(t2); t2 != nil && err != nil {
-						return errwrap.Wrapf(err, "input type was inconsistent")
+				if len(path) > 0 {
+					leaf, err := descendType(typ, path)
+					if err != nil {
+						//fmt.Printf("might be using optional arg, struct is missing a field in path: %s\n", field)
+						return errwrap.Wrapf(err, "could not descend struct field path")
 					}
+					if leaf != nil {
+						if err := leaf.Cmp(t2); t2 != nil && err != nil {
+							return errwrap.Wrapf(err, "input type was inconsistent")
+						}
 
-					// learn!
-					t2 = t
+						// learn!
+						t2 = leaf
+					}
 				}
 
 				if err := typ.Cmp(t1); t1 != nil && err != nil {
@@ -284,26 +403,26 @@ func (obj *StructLookupOptionalFunc) Unify(expr interfaces.Expr) ([]interfaces.I
 			if typ, err := cfavInvar.Args[0].Type(); err == nil { // is it known?
 				// this sets t1 (and sometimes t2) on success if it learned
 				if err := validateArg0(typ); err != nil {
-					return nil, errwrap.Wrapf(err, "first struct arg type is inconsistent")
+					return nil, nil, nil, true, errwrap.Wrapf(err, "first struct arg type is inconsistent")
 				}
 			}
 			if typ, exists := solved[cfavInvar.Args[0]]; exists { // alternate way to lookup type
 				// this sets t1 (and sometimes t2) on success if it learned
 				if err := validateArg0(typ); err != nil {
-					return nil, errwrap.Wrapf(err, "first struct arg type is inconsistent")
+					return nil, nil, nil, true, errwrap.Wrapf(err, "first struct arg type is inconsistent")
 				}
 			}
 
 			if typ, err := cfavInvar.Args[2].Type(); err == nil { // is it known?
 				// this sets t2 on success if it learned
 				if err := validateArg2OrOut(typ); err != nil {
-					return nil, errwrap.Wrapf(err, "third struct arg type is inconsistent")
+					return nil, nil, nil, true, errwrap.Wrapf(err, "third struct arg type is inconsistent")
 				}
 			}
 			if typ, exists := solved[cfavInvar.Args[2]]; exists { // alternate way to lookup type
 				// this sets t2 on success if it learned
 				if err := validateArg2OrOut(typ); err != nil {
-					return nil, errwrap.Wrapf(err, "third struct arg type is inconsistent")
+					return nil, nil, nil, true, errwrap.Wrapf(err, "third struct arg type is inconsistent")
 				}
 			}
 
@@ -311,13 +430,13 @@ func (obj *StructLookupOptionalFunc) Unify(expr interfaces.Expr) ([]interfaces.I
 			if typ, err := cfavInvar.Expr.Type(); err == nil { // is it known?
 				// this sets t2 on success if it learned
 				if err := validateArg2OrOut(typ); err != nil {
-					return nil, errwrap.Wrapf(err, "third struct arg type is inconsistent")
+					return nil, nil, nil, true, errwrap.Wrapf(err, "third struct arg type is inconsistent")
 				}
 			}
 			if typ, exists := solved[cfavInvar.Expr]; exists { // alternate way to lookup type
 				// this sets t2 on success if it learned
 				if err := validateArg2OrOut(typ); err != nil {
-					return nil, errwrap.Wrapf(err, "third struct arg type is inconsistent")
+					return nil, nil, nil, true, errwrap.Wrapf(err, "third struct arg type is inconsistent")
 				}
 			}
 
@@ -331,32 +450,17 @@ func (obj *StructLookupOptionalFunc) Unify(expr interfaces.Expr) ([]interfaces.I
 				invariants = append(invariants, invar)
 
 				// We know *some* information about the struct!
-				// Let's hope the unusedField expr won't trip
-				// up the solver...
-				mapped := make(map[string]interfaces.Expr)
-				ordered := []string{}
-				for _, x := range t1.Ord {
-					// We *don't* need to solve unusedField
-					unusedField := &interfaces.ExprAny{}
-					mapped[x] = unusedField
-					if x == field { // the one we care about
-						mapped[x] = dummyOut
-					}
-					ordered = append(ordered, x)
-				}
-				// We map to dummyOut which is the return type
-				// and has the same type of the field we want!
-				mapped[field] = dummyOut // redundant =D
-				invar = &interfaces.EqualityWrapStructInvariant{
-					Expr1:    dummyStruct,
-					Expr2Map: mapped,
-					Expr2Ord: ordered,
-				}
-				// We only want to add this weird thing if the
-				// field actually exists. Otherwise ignore it.
-				if _, exists := t1.Map[field]; field != "" && exists {
-					invariants = append(invariants, invar)
+				// Chain one PartialStructInvariant per path segment,
+				// descending through each nested struct level,
+				// without having to pin down any of the sibling
+				// fields we don't care about at each level. The
+				// chain stops at the first segment that's missing,
+				// so only the levels that actually exist add anything.
+				chain, err := buildChainInvariants(dummyStruct, t1, path, dummyOut)
+				if err != nil {
+					return nil, nil, nil, true, errwrap.Wrapf(err, "could not build struct chain invariants")
 				}
+				invariants = append(invariants, chain...)
 			}
 			if t2 != nil {
 				invar = &interfaces.EqualsInvariant{
@@ -371,10 +475,6 @@ func (obj *StructLookupOptionalFunc) Unify(expr interfaces.Expr) ([]interfaces.I
 				invariants = append(invariants, invar)
 			}
 
-			// XXX: if t1 or t2 are missing, we could also return a
-			// new generator for later if we learn new information,
-			// but we'd have to be careful to not do it infinitely.
-
 			// TODO: do we return this relationship with ExprCall?
 			invar = &interfaces.EqualityWrapCallInvariant{
 				// TODO: should Expr1 and Expr2 be reversed???
@@ -385,13 +485,63 @@ func (obj *StructLookupOptionalFunc) Unify(expr interfaces.Expr) ([]interfaces.I
 			invariants = append(invariants, invar)
 
 			// TODO: are there any other invariants we should build?
-			return invariants, nil // generator return
+			return t1, t2, invariants, true, nil // learn return
+		}
+		// We never even found our own CallFuncArgsValueInvariant this round.
+		return nil, nil, nil, false, fmt.Errorf("couldn't generate new invariants")
+	}
+
+	// fingerprint counts how many of t1 and t2 learn managed to pin down
+	// this round, so a later pass can tell whether it actually saw new
+	// information, or would just spin on the same inputs forever.
+	fingerprint := func(t1, t2 *types.Type) int {
+		n := 0
+		if t1 != nil {
+			n++
+		}
+		if t2 != nil {
+			n++
 		}
-		// We couldn't tell the solver anything it didn't already know!
-		return nil, fmt.Errorf("couldn't generate new invariants")
+		return n
 	}
+
+	// wrap builds a generator that re-runs learn on every pass, but only
+	// defers again while the fingerprint has strictly grown past seen, and
+	// otherwise gives up with "couldn't generate new invariants". Since
+	// the fingerprint is at most 2, this can't spin forever.
+	var wrap func(seen int) func([]interfaces.Invariant, map[interfaces.Expr]*types.Type) ([]interfaces.Invariant, error)
+	wrap = func(seen int) func([]interfaces.Invariant, map[interfaces.Expr]*types.Type) ([]interfaces.Invariant, error) {
+		return func(fnInvariants []interfaces.Invariant, solved map[interfaces.Expr]*types.Type) ([]interfaces.Invariant, error) {
+			t1, t2, invars, foundCfav, err := learn(fnInvariants, solved)
+			if err != nil {
+				return nil, err
+			}
+
+			if foundCfav && (t1 == nil || t2 == nil) {
+				fp := fingerprint(t1, t2)
+				if fp <= seen {
+					// Nothing new since last time -- give up
+					// instead of looping forever.
+					return nil, fmt.Errorf("couldn't generate new invariants")
+				}
+
+				// This is the first pass, or we pinned down more
+				// than last time, but not both types yet. Hold
+				// back what learn built this round, and come back
+				// later once the solver has made more progress.
+				return []interfaces.Invariant{
+					&interfaces.GeneratorInvariant{
+						Func: wrap(fp),
+					},
+				}, nil
+			}
+
+			return invars, nil
+		}
+	}
+
 	invar = &interfaces.GeneratorInvariant{
-		Func: fn,
+		Func: wrap(-1),
 	}
 	invariants = append(invariants, invar)
 
@@ -447,6 +597,22 @@ func (obj *StructLookupOptionalFunc) Build(typ *types.Type) (*types.Type, error)
 	obj.Type = tStruct // struct type
 	obj.Out = typ.Out  // type of return value
 
+	// If Unify managed to learn the (possibly dotted) field path, double
+	// check that every non-leaf segment actually resolves to a struct,
+	// and that the leaf segment's type (when present) matches what we're
+	// returning.
+	if len(obj.field) > 0 {
+		leaf, err := descendType(obj.Type, obj.field)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "invalid field path")
+		}
+		if leaf != nil {
+			if err := leaf.Cmp(obj.Out); err != nil {
+				return nil, errwrap.Wrapf(err, "leaf field type doesn't match return type")
+			}
+		}
+	}
+
 	return obj.sig(), nil
 }
 
@@ -519,24 +685,18 @@ func (obj *StructLookupOptionalFunc) Stream(ctx context.Context) error {
 			if field == "" {
 				return fmt.Errorf("received empty field")
 			}
-			if obj.field == "" {
-				obj.field = field // store first field
-			}
-			if field != obj.field {
-				return fmt.Errorf("input field changed from: `%s`, to: `%s`", obj.field, field)
+			if err := obj.setField(field); err != nil {
+				return err
 			}
 
 			// We know the result of this lookup statically at
 			// compile time, but for simplicity we check each time
 			// here anyways. Maybe one day there will be a fancy
-			// reason why this might vary over time.
-			var result types.Value
-			val, exists := st.Lookup(field)
-			if exists {
-				result = val
-			} else {
-				result = optional
-			}
+			// reason why this might vary over time. A dotted path
+			// like `outer.inner` descends through each nested
+			// struct in turn, falling back to optional as soon as
+			// any segment is missing.
+			result := lookupPath(st, obj.field, optional)
 
 			// if previous input was `2 + 4`, but now it
 			// changed to `1 + 5`, the result is still the
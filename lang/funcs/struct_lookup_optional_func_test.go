@@ -0,0 +1,155 @@
+// Mgmt
+// Copyright (C) 2013-2024+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Additional permission under GNU GPL version 3 section 7
+//
+// If you modify this program, or any covered work, by linking or combining it
+// with embedded mcl code and modules (and that the embedded mcl code and
+// modules which link with this program, contain a copy of their source code in
+// the authoritative form) containing parts covered by the terms of any other
+// license, the licensors of this program grant you additional permission to
+// convey the resulting work. Furthermore, the licensors of this program grant
+// the original author, James Shubin, additional permission to update this
+// additional permission if he deems it necessary to achieve the goals of this
+// additional permission.
+
+package funcs
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/lang/interfaces"
+	"github.com/purpleidea/mgmt/lang/types"
+)
+
+// runStructLookupOptional builds fn against structType/out, sends one
+// (struct, field, optional) input, and returns the result or an error.
+func runStructLookupOptional(t *testing.T, structType string, stVal *types.StructValue, field string, optional types.Value, out *types.Type) (types.Value, error) {
+	t.Helper()
+
+	fn := &StructLookupOptionalFunc{
+		Type: types.NewType(structType),
+		Out:  out,
+	}
+
+	argType := types.NewType(fmt.Sprintf("struct{%s %s; %s str; %s %s}",
+		structLookupOptionalArgNameStruct, structType,
+		structLookupOptionalArgNameField,
+		structLookupOptionalArgNameOptional, out.String()))
+	argVal, err := types.NewStruct(argType)
+	if err != nil {
+		t.Fatalf("could not build arg value: %+v", err)
+	}
+	argVal.Struct()[structLookupOptionalArgNameStruct] = stVal
+	argVal.Struct()[structLookupOptionalArgNameField] = &types.StrValue{V: field}
+	argVal.Struct()[structLookupOptionalArgNameOptional] = optional
+
+	input := make(chan types.Value)
+	output := make(chan types.Value)
+	if err := fn.Init(&interfaces.Init{Input: input, Output: output}); err != nil {
+		t.Fatalf("could not init: %+v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- fn.Stream(ctx) }()
+
+	select {
+	case input <- argVal:
+	case <-time.After(time.Second):
+		t.Fatal("timed out sending input")
+	}
+
+	var result types.Value
+	select {
+	case result = <-output:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for output")
+	}
+
+	close(input)
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func TestStructLookupOptionalFuncStreamDottedPath(t *testing.T) {
+	optional := &types.IntValue{V: -1}
+
+	// struct{a struct{x int}} -- "a" exists, but "a.b" doesn't: "b" is a
+	// missing *intermediate* segment of the dotted path "a.b.c", so we
+	// should fall back to optional as soon as we fail to find it, without
+	// ever getting to "c".
+	structType := "struct{a struct{x int}}"
+	aType := types.NewType("struct{x int}")
+
+	aVal, err := types.NewStruct(aType)
+	if err != nil {
+		t.Fatalf("could not build inner struct value: %+v", err)
+	}
+	aVal.Struct()["x"] = &types.IntValue{V: 7}
+
+	stVal, err := types.NewStruct(types.NewType(structType))
+	if err != nil {
+		t.Fatalf("could not build struct value: %+v", err)
+	}
+	stVal.Struct()["a"] = aVal
+
+	result, err := runStructLookupOptional(t, structType, stVal, "a.b.c", optional, types.TypeInt)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := result.Cmp(optional); err != nil {
+		t.Errorf("result = %+v, want optional %+v (cmp err: %+v)", result, optional, err)
+	}
+}
+
+func TestStructLookupOptionalFuncStreamDottedPathFound(t *testing.T) {
+	optional := &types.IntValue{V: -1}
+
+	// struct{a struct{x int}} -- "a.x" fully resolves, so we should get
+	// the leaf value back, not optional.
+	structType := "struct{a struct{x int}}"
+	aType := types.NewType("struct{x int}")
+
+	aVal, err := types.NewStruct(aType)
+	if err != nil {
+		t.Fatalf("could not build inner struct value: %+v", err)
+	}
+	aVal.Struct()["x"] = &types.IntValue{V: 7}
+
+	stVal, err := types.NewStruct(types.NewType(structType))
+	if err != nil {
+		t.Fatalf("could not build struct value: %+v", err)
+	}
+	stVal.Struct()["a"] = aVal
+
+	result, err := runStructLookupOptional(t, structType, stVal, "a.x", optional, types.TypeInt)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	want := &types.IntValue{V: 7}
+	if err := result.Cmp(want); err != nil {
+		t.Errorf("result = %+v, want %+v (cmp err: %+v)", result, want, err)
+	}
+}
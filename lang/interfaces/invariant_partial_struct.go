@@ -0,0 +1,166 @@
+// Mgmt
+// Copyright (C) 2013-2024+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Additional permission under GNU GPL version 3 section 7
+//
+// If you modify this program, or any covered work, by linking or combining it
+// with embedded mcl code and modules (and that the embedded mcl code and
+// modules which link with this program, contain a copy of their source code in
+// the authoritative form) containing parts covered by the terms of any other
+// license, the licensors of this program grant you additional permission to
+// convey the resulting work. Furthermore, the licensors of this program grant
+// the original author, James Shubin, additional permission to update this
+// additional permission if he deems it necessary to achieve the goals of this
+// additional permission.
+
+package interfaces
+
+import (
+	"fmt"
+
+	"github.com/purpleidea/mgmt/lang/types"
+	"github.com/purpleidea/mgmt/util/errwrap"
+)
+
+// PartialStructInvariant is a constraint that says Expr must unify with some
+// struct type that contains at least Field of type FieldType, but says
+// nothing about any of the struct's other fields. This is weaker (and more
+// useful for partial information) than EqualityWrapStructInvariant, which
+// pins down every field of the struct at once. Multiple PartialStructInvariant
+// values that share the same Expr are expected to get merged by the solver
+// into a single, growing structural constraint as more fields become known,
+// and a PartialStructInvariant is expected to reconcile with a full
+// EqualsInvariant/EqualityInvariant on the same Expr by checking containment
+// (does the full struct type have this field, with this type) rather than by
+// checking full equality. This lets us type-check mcl code that reads a few
+// fields out of a struct value whose other fields we either can't, or don't
+// need to, know about.
+type PartialStructInvariant struct {
+	Expr      Expr
+	Field     string
+	FieldType *types.Type
+}
+
+// String returns a representation of this invariant.
+func (obj *PartialStructInvariant) String() string {
+	return fmt.Sprintf("partialstruct(%p).%s(%s)", obj.Expr, obj.Field, obj.FieldType)
+}
+
+// ExprList returns the list of valid expressions in this invariant. A
+// PartialStructInvariant only ever mentions the one Expr it constrains.
+func (obj *PartialStructInvariant) ExprList() []Expr {
+	return []Expr{obj.Expr}
+}
+
+// Matches returns whether this invariant is satisfied by the given, possibly
+// partial, solution. If Expr hasn't been solved yet, this isn't an error,
+// it's simply not decidable yet, so we return false with no error. Once
+// Expr does have a known type, we don't require it to equal anything in
+// particular -- we only require that it's a struct which contains Field with
+// exactly FieldType, which is the "containment" check that lets this
+// invariant coexist with whatever else pins down the struct's other fields.
+func (obj *PartialStructInvariant) Matches(solved map[Expr]*types.Type) (bool, error) {
+	typ, exists := solved[obj.Expr]
+	if !exists || typ == nil {
+		return false, nil // not solved yet
+	}
+	if err := structContainsField(typ, obj.Field, obj.FieldType); err != nil {
+		return false, errwrap.Wrapf(err, "partial struct invariant not satisfied")
+	}
+	return true, nil
+}
+
+// Possible returns an error if it is certain that this invariant can't be
+// satisfied together with the rest of the given partials. It reconciles
+// against two kinds of invariants that might also mention our Expr: other
+// PartialStructInvariant's (which must agree on FieldType if they name the
+// same Field -- this is how the solver merges a growing pile of "has this
+// field" constraints on the same Expr into one structural view instead of
+// requiring them all to arrive at once), and EqualsInvariant's that already
+// pin Expr down to a full, concrete struct type (which must contain Field
+// with FieldType, by containment, not by being equal to it).
+func (obj *PartialStructInvariant) Possible(partials []Invariant) error {
+	for _, invariant := range partials {
+		if invariant == obj {
+			continue
+		}
+		switch x := invariant.(type) {
+		case *PartialStructInvariant:
+			if x.Expr != obj.Expr || x.Field != obj.Field {
+				continue // unrelated expr or a different field
+			}
+			if err := x.FieldType.Cmp(obj.FieldType); err != nil {
+				return errwrap.Wrapf(err, "conflicting partial struct field types for field: %s", obj.Field)
+			}
+
+		case *EqualsInvariant:
+			if x.Expr != obj.Expr || x.Type == nil {
+				continue
+			}
+			if err := structContainsField(x.Type, obj.Field, obj.FieldType); err != nil {
+				return errwrap.Wrapf(err, "struct type doesn't contain expected field")
+			}
+		}
+	}
+	return nil
+}
+
+// structContainsField checks that typ is a struct type that has field, with
+// exactly fieldType, and returns a descriptive error otherwise. This is the
+// containment check a PartialStructInvariant uses in place of the full
+// equality check an EqualsInvariant would use.
+func structContainsField(typ *types.Type, field string, fieldType *types.Type) error {
+	if typ.Kind != types.KindStruct {
+		return fmt.Errorf("expected a struct, got: %s", typ.Kind)
+	}
+	actual, exists := typ.Map[field]
+	if !exists {
+		return fmt.Errorf("struct is missing field: %s", field)
+	}
+	return actual.Cmp(fieldType)
+}
+
+// MergePartialStructInvariants groups a set of invariants by the distinct
+// structural view each PartialStructInvariant contributes to its Expr. This
+// is how the solver treats many separate "Expr has field F of type T"
+// constraints on the same Expr as one growing struct type, field by field,
+// instead of only being able to use a single EqualityWrapStructInvariant
+// that has to name every field up front. It returns an error if two
+// PartialStructInvariant's for the same Expr and Field disagree on
+// FieldType.
+func MergePartialStructInvariants(invariants []Invariant) (map[Expr]map[string]*types.Type, error) {
+	merged := make(map[Expr]map[string]*types.Type)
+	for _, invariant := range invariants {
+		partial, ok := invariant.(*PartialStructInvariant)
+		if !ok {
+			continue
+		}
+		fields, exists := merged[partial.Expr]
+		if !exists {
+			fields = make(map[string]*types.Type)
+			merged[partial.Expr] = fields
+		}
+		if existing, exists := fields[partial.Field]; exists {
+			if err := existing.Cmp(partial.FieldType); err != nil {
+				return nil, errwrap.Wrapf(err, "conflicting partial struct field types for field: %s", partial.Field)
+			}
+			continue
+		}
+		fields[partial.Field] = partial.FieldType
+	}
+	return merged, nil
+}